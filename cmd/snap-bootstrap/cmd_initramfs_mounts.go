@@ -22,6 +22,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,8 +30,14 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/sysdb"
 	"github.com/snapcore/snapd/boot"
+	"github.com/snapcore/snapd/bootloader"
+	"github.com/snapcore/snapd/cmd/snap-bootstrap/secboot"
+	"github.com/snapcore/snapd/cmd/snap-bootstrap/verity"
 	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/logger"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/seed"
 	"github.com/snapcore/snapd/snap"
@@ -51,12 +58,67 @@ func init() {
 	snap.SanitizePlugsSlots = func(*snap.Info) {}
 }
 
-type cmdInitramfsMounts struct{}
+type cmdInitramfsMounts struct {
+	Format string `long:"format" choice:"legacy" choice:"json" default:"legacy"`
+}
 
 func (c *cmdInitramfsMounts) Execute(args []string) error {
+	mountFormat = c.Format
 	return generateInitramfsMounts()
 }
 
+// mountTuple describes one mount the initramfs should perform. Source and
+// Target are always set; FSType, Options and Bind are zero-valued ("",
+// nil, false) when not needed. emit turns it into whatever wire format
+// mountFormat currently selects.
+type mountTuple struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	FSType  string   `json:"fstype,omitempty"`
+	Options []string `json:"options,omitempty"`
+	Bind    bool     `json:"bind,omitempty"`
+}
+
+var (
+	// mountFormat selects the wire format emit uses - "legacy" (the
+	// historical ad-hoc "src dst"/"--type=tmpfs tmpfs dst" lines the
+	// current initramfs script parses) or "json" (one mountTuple per
+	// line, for scripts that want the full Options/Bind information).
+	mountFormat = "legacy"
+)
+
+// emit writes t to w in the format selected by mountFormat.
+func emit(w io.Writer, t mountTuple) error {
+	if mountFormat == "json" {
+		enc := json.NewEncoder(w)
+		return enc.Encode(t)
+	}
+	return emitLegacy(w, t)
+}
+
+// emitLegacy renders t the way generateMountsMode* always has, so the
+// current shell-based initramfs wrapper keeps working unmodified: a bare
+// "src dst" line, or "--type=<fstype>[,<comma-joined-options>] src dst"
+// when FSType or Options is set. FSType and Options are independent -
+// a verity mount sets both and needs both to show up on the line. With
+// no FSType, the line starts "--type=<comma-joined-options>".
+func emitLegacy(w io.Writer, t mountTuple) error {
+	if t.FSType == "" && len(t.Options) == 0 {
+		_, err := fmt.Fprintf(w, "%s %s\n", t.Source, t.Target)
+		return err
+	}
+	typeArg := t.FSType
+	if len(t.Options) > 0 {
+		if typeArg == "" {
+			typeArg = strings.Join(t.Options, ",")
+		} else {
+			typeArg += "," + strings.Join(t.Options, ",")
+		}
+	}
+	_, err := fmt.Fprintf(w, "--type=%s %s %s\n", typeArg, t.Source, t.Target)
+	return err
+}
+
 var (
 	// the kernel commandline - can be overridden in tests
 	procCmdline = "/proc/cmdline"
@@ -68,25 +130,116 @@ var (
 var (
 	runMnt = "/run/mnt"
 
-	osutilIsMounted = osutil.IsMounted
+	osutilIsMounted                 = osutil.IsMounted
+	secbootUnlockEncryptedPartition = secboot.UnlockEncryptedPartition
 )
 
-// generateMountsMode* is called multiple times from initramfs until it
-// no longer generates more mount points and just returns an empty output.
-func generateMountsModeInstall(recoverySystem string) error {
-	seedDir := filepath.Join(runMnt, "ubuntu-seed")
+// KernelMismatchError is returned when the kernel snap that would be
+// mounted does not match the kernel the bootloader actually booted, so
+// that a caller (ultimately the initramfs) can fall back to a known-good
+// kernel instead of hanging with a kernel that was never measured/trusted
+// by the boot chain.
+type KernelMismatchError struct {
+	Expected string
+	Got      string
+}
 
-	// 1. always ensure seed partition is mounted
-	isMounted, err := osutilIsMounted(seedDir)
+func (e *KernelMismatchError) Error() string {
+	return fmt.Sprintf("kernel found does not match kernel expected by bootloader: %q != %q", e.Got, e.Expected)
+}
+
+// bootVars reads the given bootloader environment variables straight from
+// the bootloader found at rootdir. The boot package's helpers all assume a
+// writable ubuntu-data with a device context to work from, which the
+// initramfs does not have yet at this point (ubuntu-seed/ubuntu-boot are
+// the only things mounted) - so both the recovery and run-mode kernel
+// cross-checks below go to bootloader.GetBootVars directly instead.
+func bootVars(rootdir string, names ...string) (map[string]string, error) {
+	bl, err := bootloader.Find(rootdir, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !isMounted {
-		fmt.Fprintf(stdout, "/dev/disk/by-label/ubuntu-seed %s\n", seedDir)
-		return nil
+	return bl.GetBootVars(names...)
+}
+
+// recoveryKernelSnap returns the filename of the kernel snap the
+// bootloader selected via snapd_recovery_kernel=, either from the kernel
+// commandline directly or, if that was not set, from ubuntu-seed's
+// grubenv so that we can cross-check it against what is in the seed.
+func recoveryKernelSnap(seedDir, cmdlineKernel string) (string, error) {
+	if cmdlineKernel != "" {
+		return cmdlineKernel, nil
+	}
+	m, err := bootVars(seedDir, "snapd_recovery_kernel")
+	if err != nil {
+		return "", err
+	}
+	return m["snapd_recovery_kernel"], nil
+}
+
+// findRecoverySystem auto-discovers the recovery system to use when the
+// kernel commandline did not supply a snapd_recovery_system= label. It globs
+// the seed's systems/ directory and requires exactly one candidate - if
+// there are zero or multiple systems present it is an error because we
+// cannot decide which one to use automatically.
+func findRecoverySystem(seedDir string) (systemLabel string, err error) {
+	systems, err := filepath.Glob(filepath.Join(seedDir, "systems", "*"))
+	if err != nil {
+		return "", err
+	}
+	switch len(systems) {
+	case 0:
+		return "", fmt.Errorf("cannot find a recovery system in %q", seedDir)
+	case 1:
+		return filepath.Base(systems[0]), nil
+	default:
+		return "", fmt.Errorf("cannot select recovery system, candidates: %v", systems)
+	}
+}
+
+// openTrustedAssertionDatabase opens a temporary, memory-backed assertion
+// database seeded with the usual trusted root/store keys, suitable for
+// looking up snap-revision assertions loaded from a seed.
+func openTrustedAssertionDatabase() (*asserts.Database, error) {
+	return asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   sysdb.Trusted(),
+	})
+}
+
+// verifiedMountTuple builds the mount tuple for the snap at snapPath,
+// verified against its seed-trusted dm-verity root hash unless
+// insecureVerity is set, in which case the raw squashfs is mounted
+// directly as before - an opt-out meant only for development seeds that
+// lack verity metadata.
+func verifiedMountTuple(db *asserts.Database, snapPath string, si *snap.SideInfo, target string, insecureVerity bool) (mountTuple, error) {
+	if insecureVerity {
+		return mountTuple{Source: snapPath, Target: target}, nil
+	}
+	p, err := verity.ParamsForSnap(db, snapPath, si)
+	if err != nil {
+		return mountTuple{}, err
 	}
+	return mountTuple{
+		Source: snapPath,
+		Target: target,
+		FSType: "verity",
+		Options: []string{
+			"roothash=" + p.RootHash,
+			"hashtree=" + p.HashTreePath,
+			fmt.Sprintf("hashoffset=%d", p.HashOffset),
+		},
+	}, nil
+}
 
-	// 2. (auto) select recovery system for now
+// mountEssentialSnaps loads the given recovery system from seedDir and,
+// for each essential snap (base, kernel, snapd) that is not mounted yet,
+// emits a mount tuple for it under runMnt. It is shared between install
+// and recover mode, which both need the same base/kernel/snapd set up
+// from the seed before they can do their own mode-specific work. Unless
+// insecureVerity is set, each mount tuple is backed by the snap's
+// seed-trusted dm-verity root hash.
+func mountEssentialSnaps(seedDir, recoverySystem, expectedKernel string, insecureVerity bool) error {
 	isBaseMounted, err := osutilIsMounted(filepath.Join(runMnt, "base"))
 	if err != nil {
 		return err
@@ -99,50 +252,101 @@ func generateMountsModeInstall(recoverySystem string) error {
 	if err != nil {
 		return err
 	}
-	if !isBaseMounted || !isKernelMounted || !isSnapdMounted {
-		// load the recovery system  and generate mounts for kernel/base
-		systemSeed, err := seed.Open(seedDir, recoverySystem)
+	if isBaseMounted && isKernelMounted && isSnapdMounted {
+		return nil
+	}
+
+	// load the recovery system  and generate mounts for kernel/base
+	systemSeed, err := seed.Open(seedDir, recoverySystem)
+	if err != nil {
+		return err
+	}
+	db, err := openTrustedAssertionDatabase()
+	if err != nil {
+		return err
+	}
+	commitTo := func(b *asserts.Batch) error { return b.CommitTo(db, nil) }
+	if err := systemSeed.LoadAssertions(db, commitTo); err != nil {
+		return err
+	}
+	perf := timings.New(nil)
+	// XXX: LoadMeta will verify all the snaps in the
+	// seed, that is probably too much. We can expose more
+	// dedicated helpers for this later.
+	if err := systemSeed.LoadMeta(perf); err != nil {
+		return err
+	}
+	for _, essentialSnap := range systemSeed.EssentialSnaps() {
+		snapf, err := snap.Open(essentialSnap.Path)
 		if err != nil {
 			return err
 		}
-		// load assertions into a temporary database
-		if err := systemSeed.LoadAssertions(nil, nil); err != nil {
-			return err
-		}
-		perf := timings.New(nil)
-		// XXX: LoadMeta will verify all the snaps in the
-		// seed, that is probably too much. We can expose more
-		// dedicated helpers for this later.
-		if err := systemSeed.LoadMeta(perf); err != nil {
+		info, err := snap.ReadInfoFromSnapFile(snapf, essentialSnap.SideInfo)
+		if err != nil {
 			return err
 		}
-		// XXX: do we need more cross checks here?
-		for _, essentialSnap := range systemSeed.EssentialSnaps() {
-			snapf, err := snap.Open(essentialSnap.Path)
-			if err != nil {
-				return err
-			}
-			info, err := snap.ReadInfoFromSnapFile(snapf, essentialSnap.SideInfo)
-			if err != nil {
-				return err
+		switch info.GetType() {
+		case snap.TypeBase:
+			if !isBaseMounted {
+				t, err := verifiedMountTuple(db, essentialSnap.Path, essentialSnap.SideInfo, filepath.Join(runMnt, "base"), insecureVerity)
+				if err != nil {
+					return err
+				}
+				if err := emit(stdout, t); err != nil {
+					return err
+				}
 			}
-			switch info.GetType() {
-			case snap.TypeBase:
-				if !isBaseMounted {
-					fmt.Fprintf(stdout, "%s %s\n", essentialSnap.Path, filepath.Join(runMnt, "base"))
+		case snap.TypeKernel:
+			if !isKernelMounted {
+				// cross-check against what grub actually selected before
+				// we mount it - an unverified kernel must never be booted
+				if got := filepath.Base(essentialSnap.Path); got != expectedKernel {
+					return &KernelMismatchError{Expected: expectedKernel, Got: got}
 				}
-			case snap.TypeKernel:
-				if !isKernelMounted {
-					// XXX: we need to cross-check the kernel path with snapd_recovery_kernel used by grub
-					fmt.Fprintf(stdout, "%s %s\n", essentialSnap.Path, filepath.Join(runMnt, "kernel"))
+				t, err := verifiedMountTuple(db, essentialSnap.Path, essentialSnap.SideInfo, filepath.Join(runMnt, "kernel"), insecureVerity)
+				if err != nil {
+					return err
 				}
-			case snap.TypeSnapd:
-				if !isSnapdMounted {
-					fmt.Fprintf(stdout, "%s %s\n", essentialSnap.Path, filepath.Join(runMnt, "snapd"))
+				if err := emit(stdout, t); err != nil {
+					return err
+				}
+			}
+		case snap.TypeSnapd:
+			if !isSnapdMounted {
+				t, err := verifiedMountTuple(db, essentialSnap.Path, essentialSnap.SideInfo, filepath.Join(runMnt, "snapd"), insecureVerity)
+				if err != nil {
+					return err
+				}
+				if err := emit(stdout, t); err != nil {
+					return err
 				}
 			}
 		}
 	}
+	return nil
+}
+
+// generateMountsMode* is called multiple times from initramfs until it
+// no longer generates more mount points and just returns an empty output.
+func generateMountsModeInstall(seedDir, recoverySystem, cmdlineKernel string, insecureVerity bool) error {
+	// 1. always ensure seed partition is mounted
+	isMounted, err := osutilIsMounted(seedDir)
+	if err != nil {
+		return err
+	}
+	if !isMounted {
+		return emit(stdout, mountTuple{Source: "/dev/disk/by-label/ubuntu-seed", Target: seedDir})
+	}
+
+	// 2. cross-check the kernel and mount the essential snaps of the
+	//    recovery system
+	expectedKernel, err := recoveryKernelSnap(seedDir, cmdlineKernel)
+	if err != nil {
+		return err
+	}
+	if err := mountEssentialSnaps(seedDir, recoverySystem, expectedKernel, insecureVerity); err != nil {
+		return err
+	}
 
 	// 3. mount "ubuntu-data" on a tmpfs
 	isMounted, err = osutilIsMounted(filepath.Join(runMnt, "ubuntu-data"))
@@ -151,8 +355,7 @@ func generateMountsModeInstall(recoverySystem string) error {
 	}
 	if !isMounted {
 		// XXX: is there a better way?
-		fmt.Fprintf(stdout, "--type=tmpfs tmpfs /run/mnt/ubuntu-data\n")
-		return nil
+		return emit(stdout, mountTuple{Source: "tmpfs", Target: "/run/mnt/ubuntu-data", FSType: "tmpfs"})
 	}
 
 	// 4. final step: write $(ubuntu_data)/var/lib/snapd/modeenv - this
@@ -170,8 +373,140 @@ func generateMountsModeInstall(recoverySystem string) error {
 	return nil
 }
 
-func generateMountsModeRecover(recoverySystem string) error {
-	return fmt.Errorf("recover mode mount generation not implemented yet")
+func generateMountsModeRecover(seedDir, recoverySystem, cmdlineKernel string, insecureVerity bool) error {
+	// 1. always ensure seed partition is mounted
+	isMounted, err := osutilIsMounted(seedDir)
+	if err != nil {
+		return err
+	}
+	if !isMounted {
+		return emit(stdout, mountTuple{Source: "/dev/disk/by-label/ubuntu-seed", Target: seedDir})
+	}
+
+	// 2. cross-check the kernel and mount the essential snaps of the
+	//    recovery system, same as install mode
+	expectedKernel, err := recoveryKernelSnap(seedDir, cmdlineKernel)
+	if err != nil {
+		return err
+	}
+	if err := mountEssentialSnaps(seedDir, recoverySystem, expectedKernel, insecureVerity); err != nil {
+		return err
+	}
+
+	// 3. mount "ubuntu-data" on a tmpfs, as recover mode does not use the
+	//    real ubuntu-data for its own root
+	isMounted, err = osutilIsMounted(filepath.Join(runMnt, "ubuntu-data"))
+	if err != nil {
+		return err
+	}
+	if !isMounted {
+		// XXX: is there a better way?
+		return emit(stdout, mountTuple{Source: "tmpfs", Target: "/run/mnt/ubuntu-data", FSType: "tmpfs"})
+	}
+
+	// 3.1 also try to mount the real ubuntu-data, read-only, so that
+	//     recovery tooling can inspect the previous install. This is
+	//     best-effort: a missing ubuntu-data (e.g. a device that never
+	//     had a prior install) is not fatal here, so skip the mount
+	//     entirely instead of emitting a tuple for a device that does
+	//     not exist - otherwise the mount fails externally and we keep
+	//     re-emitting the same tuple forever.
+	hostDataSrc := "/dev/disk/by-label/ubuntu-data"
+	hostDataDir := filepath.Join(runMnt, "host-ubuntu-data")
+	if osutil.FileExists(hostDataSrc) {
+		isHostDataMounted, err := osutilIsMounted(hostDataDir)
+		if err != nil {
+			return err
+		}
+		if !isHostDataMounted {
+			return emit(stdout, mountTuple{Source: hostDataSrc, Target: hostDataDir, Options: []string{"ro"}})
+		}
+	}
+
+	// 4. final step: write $(ubuntu_data)/var/lib/snapd/modeenv - this
+	//    is the tmpfs we just created above
+	modeEnv := &boot.Modeenv{
+		Mode:           "recover",
+		RecoverySystem: recoverySystem,
+	}
+	if err := modeEnv.Write(filepath.Join(runMnt, "ubuntu-data", "system-data")); err != nil {
+		return err
+	}
+
+	// 5. done, no output, no error indicates to initramfs we are done
+	//    with mounting stuff
+	return nil
+}
+
+// runModeAssertionDatabase opens the assertion database persisted on
+// ubuntu-data, which is where snapd keeps the snap-revision assertions
+// for the snaps it has installed - unlike install/recover mode, there is
+// no seed to load assertions from here.
+func runModeAssertionDatabase(dataDir string) (*asserts.Database, error) {
+	backstore, err := asserts.OpenFSBackstore(filepath.Join(dataDir, "system-data", dirs.SnapAssertsDBDir))
+	if err != nil {
+		return nil, err
+	}
+	return asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: backstore,
+		Trusted:   sysdb.Trusted(),
+	})
+}
+
+// sideInfoFromSnapFileName recovers a minimal *snap.SideInfo (real name
+// and revision) from a "<name>_<revision>.snap" blob filename, which is
+// all verity.ParamsForSnap needs to produce useful error messages here -
+// modeenv only gives us the filename, not a full SideInfo.
+func sideInfoFromSnapFileName(filename string) *snap.SideInfo {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	name, revStr := base, ""
+	if idx := strings.LastIndex(base, "_"); idx >= 0 {
+		name, revStr = base[:idx], base[idx+1:]
+	}
+	si := &snap.SideInfo{RealName: name}
+	if rev, err := snap.ParseRevision(revStr); err == nil {
+		si.Revision = rev
+	}
+	return si
+}
+
+// tryingKernelMarker is where recordTryingKernel leaves the name of the
+// kernel snap run mode is trying, under dataDir/system-data - the same
+// tree modeenv itself lives in. snap-bootstrap only writes and removes
+// it; it does not read it back, and committing to the try-kernel or
+// rolling back is not done here.
+const tryingKernelMarker = "var/lib/snapd/boot-trying-kernel"
+
+// recordTryingKernel persists which kernel this run-mode boot is trying
+// when trying is true, or removes any marker left by a previous boot
+// otherwise, so that a marker on disk only ever describes the current
+// trying boot.
+func recordTryingKernel(dataDir, kernel string, trying bool) error {
+	marker := filepath.Join(dataDir, "system-data", tryingKernelMarker)
+	if !trying {
+		err := os.Remove(marker)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return osutil.AtomicWriteFile(marker, []byte(kernel), 0644, 0)
+}
+
+// verifiedRunModeMountTuple is like verifiedMountTuple, but always
+// enforces dm-verity - run mode has no "insecure" opt-out, since refusing
+// to boot an unverified snap is exactly the protection run mode exists
+// to provide.
+func verifiedRunModeMountTuple(dataDir, snapPath, target string) (mountTuple, error) {
+	db, err := runModeAssertionDatabase(dataDir)
+	if err != nil {
+		return mountTuple{}, err
+	}
+	t, err := verifiedMountTuple(db, snapPath, sideInfoFromSnapFileName(filepath.Base(snapPath)), target, false)
+	if err != nil {
+		return mountTuple{}, fmt.Errorf("cannot verify %q for run mode boot: %v", snapPath, err)
+	}
+	return t, nil
 }
 
 func generateMountsModeRun() error {
@@ -186,20 +521,31 @@ func generateMountsModeRun() error {
 			return err
 		}
 		if !isMounted {
-			fmt.Fprintf(stdout, "/dev/disk/by-label/%s %s\n", filepath.Base(d), d)
+			if err := emit(stdout, mountTuple{Source: filepath.Join("/dev/disk/by-label", filepath.Base(d)), Target: d}); err != nil {
+				return err
+			}
 		}
 	}
 
-	// XXX possibly will need to unseal key, and unlock LUKS here before proceeding to mount data
-
 	// 1.2 mount Data, and exit, as it needs to be mounted for us to do step 2
 	isDataMounted, err := osutilIsMounted(dataDir)
 	if err != nil {
 		return err
 	}
 	if !isDataMounted {
-		fmt.Fprintf(stdout, "/dev/disk/by-label/%s %s\n", filepath.Base(dataDir), dataDir)
-		return nil
+		dataSrc := filepath.Join("/dev/disk/by-label", filepath.Base(dataDir))
+		// if there is an encrypted data partition, unseal the key
+		// (from the TPM, or a plaintext keyfile as a fallback for
+		// devices without one) and unlock it before mounting
+		encDevice := "/dev/disk/by-partlabel/ubuntu-data-enc"
+		unlocked, err := secbootUnlockEncryptedPartition("ubuntu-data", encDevice, seedDir)
+		if err != nil {
+			return err
+		}
+		if unlocked.IsEncrypted {
+			dataSrc = unlocked.MapperName
+		}
+		return emit(stdout, mountTuple{Source: dataSrc, Target: dataDir})
 	}
 	// 2.1 read modeenv
 	modeEnv, err := boot.ReadModeenv(filepath.Join(dataDir, "system-data"))
@@ -213,16 +559,51 @@ func generateMountsModeRun() error {
 	}
 	if !isBaseMounted {
 		base := filepath.Join(dataDir, "system-data", dirs.SnapBlobDir, modeEnv.Base)
-		fmt.Fprintf(stdout, "%s %s\n", base, filepath.Join(runMnt, "base"))
+		t, err := verifiedRunModeMountTuple(dataDir, base, filepath.Join(runMnt, "base"))
+		if err != nil {
+			return err
+		}
+		if err := emit(stdout, t); err != nil {
+			return err
+		}
 	}
 	isKernelMounted, err := osutilIsMounted(filepath.Join(runMnt, "kernel"))
 	if err != nil {
 		return err
 	}
 	if !isKernelMounted {
-		// XXX: do we need to cross-check the booted/running kernel vs the snap?
+		// cross-check the kernel snap_mode/snap_kernel/snap_try_kernel
+		// bootenv on ubuntu-boot against the kernel in the modeenv,
+		// honoring snap_mode=trying by preferring the try slot
+		m, err := bootVars(bootDir, "snap_mode", "snap_kernel", "snap_try_kernel")
+		if err != nil {
+			return err
+		}
+		expectedKernel := m["snap_kernel"]
+		trying := m["snap_mode"] == "trying"
+		if trying && m["snap_try_kernel"] != "" {
+			expectedKernel = m["snap_try_kernel"]
+		}
+		if expectedKernel != modeEnv.Kernel {
+			return &KernelMismatchError{Expected: expectedKernel, Got: modeEnv.Kernel}
+		}
+		// record which kernel this boot is trying - we successfully got
+		// this far booting the try-kernel, but no commit/rollback
+		// decision is made here
+		if err := recordTryingKernel(dataDir, expectedKernel, trying); err != nil {
+			return err
+		}
+		if trying {
+			logger.Noticef("try-kernel %q matches modeenv, continuing boot", expectedKernel)
+		}
 		kernel := filepath.Join(dataDir, "system-data", dirs.SnapBlobDir, modeEnv.Kernel)
-		fmt.Fprintf(stdout, "%s %s\n", kernel, filepath.Join(runMnt, "kernel"))
+		t, err := verifiedRunModeMountTuple(dataDir, kernel, filepath.Join(runMnt, "kernel"))
+		if err != nil {
+			return err
+		}
+		if err := emit(stdout, t); err != nil {
+			return err
+		}
 	}
 	// 3.1 There is no step 3 =)
 	return nil
@@ -230,7 +611,7 @@ func generateMountsModeRun() error {
 
 var validModes = []string{"install", "recover", "run"}
 
-func whichModeAndRecoverSystem(cmdline []byte) (mode string, sysLabel string, err error) {
+func whichModeAndRecoverSystem(cmdline []byte) (mode, sysLabel, kernel string, insecureVerity bool, err error) {
 	scanner := bufio.NewScanner(bytes.NewBuffer(cmdline))
 	scanner.Split(bufio.ScanWords)
 	for scanner.Scan() {
@@ -240,23 +621,35 @@ func whichModeAndRecoverSystem(cmdline []byte) (mode string, sysLabel string, er
 				mode = "install"
 			}
 			if !strutil.ListContains(validModes, mode) {
-				return "", "", fmt.Errorf("cannot use unknown mode %q", mode)
+				return "", "", "", false, fmt.Errorf("cannot use unknown mode %q", mode)
 			}
 			if mode == "run" {
-				return "run", "", nil
+				return "run", "", "", false, nil
 			}
 		}
 		if strings.HasPrefix(scanner.Text(), "snapd_recovery_system=") {
 			sysLabel = strings.SplitN(scanner.Text(), "=", 2)[1]
 		}
-		if mode != "" && sysLabel != "" {
-			return mode, sysLabel, nil
+		if strings.HasPrefix(scanner.Text(), "snapd_recovery_kernel=") {
+			kernel = strings.SplitN(scanner.Text(), "=", 2)[1]
+		}
+		if strings.HasPrefix(scanner.Text(), "snapd_recovery_verity=") {
+			// an explicit opt-out for development seeds that lack
+			// dm-verity metadata - anything else keeps verification on
+			insecureVerity = strings.SplitN(scanner.Text(), "=", 2)[1] == "0"
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return "", "", err
+		return "", "", "", false, err
+	}
+	if mode == "" {
+		return "", "", "", false, fmt.Errorf("cannot detect mode nor recovery system to use")
 	}
-	return "", "", fmt.Errorf("cannot detect mode nor recovery system to use")
+	// mode is set but snapd_recovery_system= may not have been given - the
+	// caller will auto-discover the recovery system once ubuntu-seed is
+	// mounted; snapd_recovery_kernel= may also be empty, in which case the
+	// caller falls back to reading it from ubuntu-seed's grubenv
+	return mode, sysLabel, kernel, insecureVerity, nil
 }
 
 func generateInitramfsMounts() error {
@@ -264,17 +657,36 @@ func generateInitramfsMounts() error {
 	if err != nil {
 		return err
 	}
-	mode, recoverySystem, err := whichModeAndRecoverSystem(cmdline)
+	mode, recoverySystem, cmdlineKernel, insecureVerity, err := whichModeAndRecoverSystem(cmdline)
 	if err != nil {
 		return err
 	}
+	if mode == "run" {
+		return generateMountsModeRun()
+	}
+
+	// install and recover modes both need ubuntu-seed mounted first; if
+	// the cmdline did not give us a recovery system label, this is the
+	// second pass where we can glob ubuntu-seed/systems/* to find it.
+	seedDir := filepath.Join(runMnt, "ubuntu-seed")
+	if recoverySystem == "" {
+		isMounted, err := osutilIsMounted(seedDir)
+		if err != nil {
+			return err
+		}
+		if isMounted {
+			recoverySystem, err = findRecoverySystem(seedDir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	switch mode {
 	case "recover":
-		return generateMountsModeRecover(recoverySystem)
+		return generateMountsModeRecover(seedDir, recoverySystem, cmdlineKernel, insecureVerity)
 	case "install":
-		return generateMountsModeInstall(recoverySystem)
-	case "run":
-		return generateMountsModeRun()
+		return generateMountsModeInstall(seedDir, recoverySystem, cmdlineKernel, insecureVerity)
 	}
 	// this should never be reached
 	return fmt.Errorf("internal error: mode in generateInitramfsMounts not handled")
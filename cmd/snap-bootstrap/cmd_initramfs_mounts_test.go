@@ -0,0 +1,191 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/bootloader"
+	"github.com/snapcore/snapd/bootloader/bootloadertest"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type initramfsMountsSuite struct{}
+
+var _ = Suite(&initramfsMountsSuite{})
+
+func (s *initramfsMountsSuite) TestEmitLegacyBareMount(c *C) {
+	buf := &bytes.Buffer{}
+	err := emitLegacy(buf, mountTuple{Source: "/dev/sda1", Target: "/run/mnt/data"})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "/dev/sda1 /run/mnt/data\n")
+}
+
+func (s *initramfsMountsSuite) TestEmitLegacyFSTypeOnly(c *C) {
+	buf := &bytes.Buffer{}
+	err := emitLegacy(buf, mountTuple{Source: "tmpfs", Target: "/run/mnt/ubuntu-data", FSType: "tmpfs"})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "--type=tmpfs tmpfs /run/mnt/ubuntu-data\n")
+}
+
+func (s *initramfsMountsSuite) TestEmitLegacyOptionsOnly(c *C) {
+	buf := &bytes.Buffer{}
+	err := emitLegacy(buf, mountTuple{
+		Source:  "/dev/disk/by-label/ubuntu-data",
+		Target:  "/run/mnt/host-ubuntu-data",
+		Options: []string{"ro"},
+	})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "--type=ro /dev/disk/by-label/ubuntu-data /run/mnt/host-ubuntu-data\n")
+}
+
+// TestEmitLegacyFSTypeAndOptions guards against FSType and Options being
+// treated as mutually exclusive - a verity-backed mount tuple sets both
+// and needs both to appear on the legacy line, otherwise the root hash,
+// hash tree path and offset are silently dropped.
+func (s *initramfsMountsSuite) TestEmitLegacyFSTypeAndOptions(c *C) {
+	buf := &bytes.Buffer{}
+	err := emitLegacy(buf, mountTuple{
+		Source: "/run/mnt/ubuntu-seed/snaps/core20_1.snap",
+		Target: "/run/mnt/base",
+		FSType: "verity",
+		Options: []string{
+			"roothash=deadbeef",
+			"hashtree=/run/mnt/ubuntu-seed/snaps/core20_1.snap.verity",
+			"hashoffset=0",
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "--type=verity,roothash=deadbeef,hashtree=/run/mnt/ubuntu-seed/snaps/core20_1.snap.verity,hashoffset=0 /run/mnt/ubuntu-seed/snaps/core20_1.snap /run/mnt/base\n")
+}
+
+func (s *initramfsMountsSuite) TestEmitDispatchesOnMountFormat(c *C) {
+	old := mountFormat
+	defer func() { mountFormat = old }()
+
+	t := mountTuple{Source: "a", Target: "b", FSType: "verity", Options: []string{"roothash=x"}}
+
+	mountFormat = "legacy"
+	buf := &bytes.Buffer{}
+	c.Assert(emit(buf, t), IsNil)
+	c.Check(buf.String(), Equals, "--type=verity,roothash=x a b\n")
+
+	mountFormat = "json"
+	buf = &bytes.Buffer{}
+	c.Assert(emit(buf, t), IsNil)
+	c.Check(buf.String(), Equals, `{"source":"a","target":"b","fstype":"verity","options":["roothash=x"]}`+"\n")
+}
+
+func (s *initramfsMountsSuite) TestRecoveryKernelSnapFromCmdline(c *C) {
+	kernel, err := recoveryKernelSnap("/unused", "pc-kernel_1.snap")
+	c.Assert(err, IsNil)
+	c.Check(kernel, Equals, "pc-kernel_1.snap")
+}
+
+// TestRecoveryKernelSnapGrubenvFallback covers the case the cmdline did
+// not carry snapd_recovery_kernel= at all, so recoveryKernelSnap has to
+// fall back to reading it from ubuntu-seed's grubenv via bootVars.
+func (s *initramfsMountsSuite) TestRecoveryKernelSnapGrubenvFallback(c *C) {
+	seedDir := c.MkDir()
+	bl := bootloadertest.Mock("grub", seedDir)
+	c.Assert(bl.SetBootVars(map[string]string{"snapd_recovery_kernel": "pc-kernel_2.snap"}), IsNil)
+	bootloader.Force(bl)
+	defer bootloader.Force(nil)
+
+	kernel, err := recoveryKernelSnap(seedDir, "")
+	c.Assert(err, IsNil)
+	c.Check(kernel, Equals, "pc-kernel_2.snap")
+}
+
+func (s *initramfsMountsSuite) TestFindRecoverySystemNone(c *C) {
+	seedDir := c.MkDir()
+	_, err := findRecoverySystem(seedDir)
+	c.Assert(err, ErrorMatches, `cannot find a recovery system in ".*"`)
+}
+
+func (s *initramfsMountsSuite) TestFindRecoverySystemOne(c *C) {
+	seedDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(seedDir, "systems", "20200101"), 0755), IsNil)
+
+	label, err := findRecoverySystem(seedDir)
+	c.Assert(err, IsNil)
+	c.Check(label, Equals, "20200101")
+}
+
+func (s *initramfsMountsSuite) TestFindRecoverySystemMultiple(c *C) {
+	seedDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(seedDir, "systems", "20200101"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(seedDir, "systems", "20200102"), 0755), IsNil)
+
+	_, err := findRecoverySystem(seedDir)
+	c.Assert(err, ErrorMatches, `cannot select recovery system, candidates: .*`)
+}
+
+func (s *initramfsMountsSuite) TestKernelMismatchErrorMessage(c *C) {
+	err := &KernelMismatchError{Expected: "pc-kernel_1.snap", Got: "pc-kernel_2.snap"}
+	c.Check(err.Error(), Equals, `kernel found does not match kernel expected by bootloader: "pc-kernel_2.snap" != "pc-kernel_1.snap"`)
+}
+
+func (s *initramfsMountsSuite) TestMountEssentialSnapsAlreadyMounted(c *C) {
+	oldIsMounted := osutilIsMounted
+	defer func() { osutilIsMounted = oldIsMounted }()
+	osutilIsMounted = func(path string) (bool, error) { return true, nil }
+
+	// with base/kernel/snapd all already mounted, mountEssentialSnaps must
+	// return before ever trying to open the seed
+	c.Assert(mountEssentialSnaps("/unused-seed", "20200101", "pc-kernel_1.snap", false), IsNil)
+}
+
+// TestGenerateMountsModeRecoverSkipsMissingHostData is a regression test
+// for the host-ubuntu-data mount: on a device with no prior install,
+// /dev/disk/by-label/ubuntu-data does not exist, so recover mode must
+// skip straight past it to writing modeenv instead of re-emitting the
+// same mount tuple forever.
+func (s *initramfsMountsSuite) TestGenerateMountsModeRecoverSkipsMissingHostData(c *C) {
+	oldRunMnt := runMnt
+	defer func() { runMnt = oldRunMnt }()
+	runMnt = c.MkDir()
+
+	oldIsMounted := osutilIsMounted
+	defer func() { osutilIsMounted = oldIsMounted }()
+	osutilIsMounted = func(path string) (bool, error) {
+		// everything but the host ubuntu-data is already mounted, so the
+		// host-data branch is the only one left to decide the output
+		return path != filepath.Join(runMnt, "host-ubuntu-data"), nil
+	}
+
+	oldStdout := stdout
+	defer func() { stdout = oldStdout }()
+	buf := &bytes.Buffer{}
+	stdout = buf
+
+	c.Assert(os.MkdirAll(filepath.Join(runMnt, "ubuntu-data", "system-data"), 0755), IsNil)
+
+	seedDir := filepath.Join(c.MkDir(), "ubuntu-seed")
+	err := generateMountsModeRecover(seedDir, "20200101", "pc-kernel_1.snap", false)
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "")
+}
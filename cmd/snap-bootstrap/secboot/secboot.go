@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package secboot deals with unsealing TPM protected keys and unlocking
+// the LUKS2 encrypted ubuntu-data partition during run mode boot.
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+
+	sb "github.com/snapcore/secboot"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// well-known locations of the key material on ubuntu-seed
+const (
+	sealedKeyUnder = "device/fde/ubuntu-data.sealed-key"
+	plainKeyUnder  = "device/fde/ubuntu-data.key"
+)
+
+var (
+	// hooks for testing
+	secbootUnsealKeyFromTPM = unsealKeyFromTPM
+	cryptsetupLuksOpen      = runCryptsetupLuksOpen
+)
+
+// UnlockResult carries the outcome of UnlockEncryptedPartition, so that
+// callers can decide which device node to mount.
+type UnlockResult struct {
+	// IsEncrypted is true when device was a LUKS2 encrypted partition
+	// that was successfully unlocked into MapperName.
+	IsEncrypted bool
+	// MapperName is the device-mapper node (e.g. "/dev/mapper/ubuntu-data")
+	// that was opened, valid only when IsEncrypted is true.
+	MapperName string
+}
+
+// UnlockEncryptedPartition obtains the unlock key for device - either by
+// unsealing a TPM-protected key found on seedDir, or by falling back to a
+// plaintext keyfile for devices without a TPM - and uses it to open device
+// as a LUKS2 partition under the device-mapper name name. If device does
+// not exist at all (e.g. the gadget did not lay out an encrypted
+// partition) it returns a zero UnlockResult and no error so that the
+// caller can fall back to the plain, unencrypted partition.
+func UnlockEncryptedPartition(name, device, seedDir string) (UnlockResult, error) {
+	if !osutil.FileExists(device) {
+		return UnlockResult{}, nil
+	}
+
+	key, err := obtainKey(seedDir)
+	if err != nil {
+		return UnlockResult{}, err
+	}
+	if err := cryptsetupLuksOpen(name, device, key); err != nil {
+		return UnlockResult{}, err
+	}
+
+	return UnlockResult{IsEncrypted: true, MapperName: filepath.Join("/dev/mapper", name)}, nil
+}
+
+func obtainKey(seedDir string) ([]byte, error) {
+	sealedKeyPath := filepath.Join(seedDir, sealedKeyUnder)
+	if osutil.FileExists(sealedKeyPath) {
+		sealed, err := ioutil.ReadFile(sealedKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		return secbootUnsealKeyFromTPM(sealed)
+	}
+
+	// no sealed key - fall back to a plaintext keyfile for devices
+	// without a TPM
+	plainKeyPath := filepath.Join(seedDir, plainKeyUnder)
+	if osutil.FileExists(plainKeyPath) {
+		return ioutil.ReadFile(plainKeyPath)
+	}
+
+	return nil, fmt.Errorf("cannot find a sealed or plaintext key for %q", seedDir)
+}
+
+// unsealKeyFromTPM unseals sealed against the TPM, using a PCR policy
+// bound to the measured boot chain (grub, shim, kernel and the kernel
+// command line). The actual PCR selection and verification is delegated
+// to the secboot library.
+func unsealKeyFromTPM(sealed []byte) ([]byte, error) {
+	return sb.UnsealKeyFromTPM(sealed, sb.DefaultPCRProfile)
+}
+
+func runCryptsetupLuksOpen(name, device string, key []byte) error {
+	cmd := exec.Command("cryptsetup", "luksOpen", device, name, "--key-file=-")
+	cmd.Stdin = bytes.NewReader(key)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(output, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/cmd/snap-bootstrap/secboot"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type secbootSuite struct{}
+
+var _ = Suite(&secbootSuite{})
+
+func (s *secbootSuite) TestUnlockEncryptedPartitionNoDevice(c *C) {
+	res, err := secboot.UnlockEncryptedPartition("ubuntu-data", filepath.Join(c.MkDir(), "missing-enc-device"), c.MkDir())
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, secboot.UnlockResult{})
+}
+
+func (s *secbootSuite) TestUnlockEncryptedPartitionSealedKey(c *C) {
+	seedDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(seedDir, "device/fde"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(seedDir, "device/fde/ubuntu-data.sealed-key"), []byte("sealed"), 0600), IsNil)
+
+	device := filepath.Join(c.MkDir(), "enc-device")
+	c.Assert(ioutil.WriteFile(device, nil, 0644), IsNil)
+
+	restore := secboot.MockSecbootUnsealKeyFromTPM(func(sealed []byte) ([]byte, error) {
+		c.Check(string(sealed), Equals, "sealed")
+		return []byte("unsealed-key"), nil
+	})
+	defer restore()
+
+	var gotName, gotDevice string
+	var gotKey []byte
+	restore = secboot.MockCryptsetupLuksOpen(func(name, device string, key []byte) error {
+		gotName, gotDevice, gotKey = name, device, key
+		return nil
+	})
+	defer restore()
+
+	res, err := secboot.UnlockEncryptedPartition("ubuntu-data", device, seedDir)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, secboot.UnlockResult{IsEncrypted: true, MapperName: "/dev/mapper/ubuntu-data"})
+	c.Check(gotName, Equals, "ubuntu-data")
+	c.Check(gotDevice, Equals, device)
+	c.Check(string(gotKey), Equals, "unsealed-key")
+}
+
+func (s *secbootSuite) TestUnlockEncryptedPartitionLuksOpenError(c *C) {
+	seedDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(seedDir, "device/fde"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(seedDir, "device/fde/ubuntu-data.key"), []byte("plain-key"), 0600), IsNil)
+
+	device := filepath.Join(c.MkDir(), "enc-device")
+	c.Assert(ioutil.WriteFile(device, nil, 0644), IsNil)
+
+	restore := secboot.MockCryptsetupLuksOpen(func(name, device string, key []byte) error {
+		return errors.New("boom")
+	})
+	defer restore()
+
+	res, err := secboot.UnlockEncryptedPartition("ubuntu-data", device, seedDir)
+	c.Assert(err, ErrorMatches, "boom")
+	c.Check(res, Equals, secboot.UnlockResult{})
+}
@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package verity parses the dm-verity root hash trusted for a given snap
+// out of the seed assertions and produces the parameters needed to set up
+// a dm-verity device over that snap's squashfs.
+package verity
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/snap"
+)
+
+// Params are the dm-verity parameters for one snap's squashfs, trusted
+// from the seed's assertions.
+type Params struct {
+	// RootHash is the hex-encoded root hash of the verity hash tree.
+	RootHash string
+	// HashTreePath is where the hash tree for the squashfs lives on
+	// disk - either a sidecar file next to the snap, or the snap
+	// itself when the hash tree is appended to it.
+	HashTreePath string
+	// HashOffset is the byte offset of the hash tree within
+	// HashTreePath (0 when it is a separate sidecar file).
+	HashOffset uint64
+}
+
+// sidecarSuffix is appended to a snap's path to find its hash tree when it
+// was not appended to the squashfs itself.
+const sidecarSuffix = ".verity"
+
+// ParamsForSnap returns the dm-verity parameters for the snap at
+// snapPath, given its side info, by looking up the root hash carried in
+// the snap-revision assertion for it (db must already have that
+// assertion, e.g. because the seed was loaded with LoadAssertions). It
+// resolves the on-disk hash tree location, preferring a sidecar
+// "<snapPath>.verity" file over a hash tree appended to the squashfs.
+func ParamsForSnap(db *asserts.Database, snapPath string, si *snap.SideInfo) (*Params, error) {
+	rootHash, err := rootHashFromAssertion(db, snapPath, si)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecar := snapPath + sidecarSuffix
+	if osutil.FileExists(sidecar) {
+		return &Params{RootHash: rootHash, HashTreePath: sidecar}, nil
+	}
+
+	offset, err := appendedHashTreeOffset(snapPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Params{RootHash: rootHash, HashTreePath: snapPath, HashOffset: offset}, nil
+}
+
+func rootHashFromAssertion(db *asserts.Database, snapPath string, si *snap.SideInfo) (string, error) {
+	digest, _, err := asserts.SnapFileSHA3_384(snapPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute digest of %q: %v", snapPath, err)
+	}
+	a, err := db.Find(asserts.SnapRevisionType, map[string]string{
+		"snap-sha3-384": digest,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot find snap-revision assertion for %q: %v", si.RealName, err)
+	}
+	snapRev := a.(*asserts.SnapRevision)
+	rootHash := snapRev.HeaderString("integrity-root-hash")
+	if rootHash == "" {
+		return "", fmt.Errorf("snap-revision assertion for %q carries no dm-verity root hash", si.RealName)
+	}
+	return rootHash, nil
+}
+
+// appendedHashTreeOffset returns the byte offset of a hash tree appended
+// to path, which is recorded in a trailing 8-byte, decimal, NUL-padded
+// footer written after the hash tree.
+func appendedHashTreeOffset(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	const footerSize = 8
+	if fi.Size() < footerSize {
+		return 0, fmt.Errorf("cannot find an appended dm-verity hash tree in %q", path)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, fi.Size()-footerSize); err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseUint(strings.TrimRight(string(footer), "\x00"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find an appended dm-verity hash tree in %q: %v", path, err)
+	}
+	return offset, nil
+}
@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package verity_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/asserts"
+	"github.com/snapcore/snapd/asserts/assertstest"
+	"github.com/snapcore/snapd/cmd/snap-bootstrap/verity"
+	"github.com/snapcore/snapd/snap"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type veritySuite struct {
+	storeSigning *assertstest.StoreStack
+	db           *asserts.Database
+}
+
+var _ = Suite(&veritySuite{})
+
+func (s *veritySuite) SetUpTest(c *C) {
+	s.storeSigning = assertstest.NewStoreStack("canonical", nil)
+	db, err := asserts.OpenDatabase(&asserts.DatabaseConfig{
+		Backstore: asserts.NewMemoryBackstore(),
+		Trusted:   s.storeSigning.Trusted,
+	})
+	c.Assert(err, IsNil)
+	s.db = db
+}
+
+// addSnapRevision signs and adds a snap-revision assertion for the snap at
+// snapPath, carrying rootHash under the integrity-root-hash header that
+// rootHashFromAssertion reads back, and returns a matching SideInfo.
+func (s *veritySuite) addSnapRevision(c *C, snapName, snapPath, rootHash string) *snap.SideInfo {
+	digest, size, err := asserts.SnapFileSHA3_384(snapPath)
+	c.Assert(err, IsNil)
+
+	headers := map[string]interface{}{
+		"snap-sha3-384":       digest,
+		"snap-size":           fmt.Sprintf("%d", size),
+		"snap-id":             snapName + "-id",
+		"snap-revision":       "1",
+		"developer-id":        s.storeSigning.AuthorityID,
+		"integrity-root-hash": rootHash,
+		"timestamp":           time.Now().Format(time.RFC3339),
+	}
+	a, err := s.storeSigning.Sign(asserts.SnapRevisionType, headers, nil, "")
+	c.Assert(err, IsNil)
+	c.Assert(s.db.Add(a), IsNil)
+
+	return &snap.SideInfo{RealName: snapName, Revision: snap.R(1)}
+}
+
+func (s *veritySuite) TestParamsForSnapSidecarHashTree(c *C) {
+	dir := c.MkDir()
+	snapPath := filepath.Join(dir, "test-snap_1.snap")
+	c.Assert(ioutil.WriteFile(snapPath, []byte("squashfs-data"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(snapPath+".verity", []byte("hash-tree-data"), 0644), IsNil)
+
+	si := s.addSnapRevision(c, "test-snap", snapPath, "deadbeef")
+
+	p, err := verity.ParamsForSnap(s.db, snapPath, si)
+	c.Assert(err, IsNil)
+	c.Check(p.RootHash, Equals, "deadbeef")
+	c.Check(p.HashTreePath, Equals, snapPath+".verity")
+	c.Check(p.HashOffset, Equals, uint64(0))
+}
+
+func (s *veritySuite) TestParamsForSnapAppendedHashTree(c *C) {
+	dir := c.MkDir()
+	snapPath := filepath.Join(dir, "test-snap_1.snap")
+	// the trailing 8 bytes are the decimal, NUL-padded offset footer
+	// appendedHashTreeOffset expects when there is no sidecar file
+	c.Assert(ioutil.WriteFile(snapPath, []byte("squashfs-data64\x00\x00\x00\x00\x00\x00"), 0644), IsNil)
+
+	si := s.addSnapRevision(c, "test-snap", snapPath, "cafef00d")
+
+	p, err := verity.ParamsForSnap(s.db, snapPath, si)
+	c.Assert(err, IsNil)
+	c.Check(p.RootHash, Equals, "cafef00d")
+	c.Check(p.HashTreePath, Equals, snapPath)
+	c.Check(p.HashOffset, Equals, uint64(64))
+}
+
+func (s *veritySuite) TestParamsForSnapNoAssertion(c *C) {
+	dir := c.MkDir()
+	snapPath := filepath.Join(dir, "unknown-snap_1.snap")
+	c.Assert(ioutil.WriteFile(snapPath, []byte("squashfs-data"), 0644), IsNil)
+
+	_, err := verity.ParamsForSnap(s.db, snapPath, &snap.SideInfo{RealName: "unknown-snap"})
+	c.Assert(err, ErrorMatches, `cannot find snap-revision assertion for "unknown-snap": .*`)
+}
+
+func (s *veritySuite) TestParamsForSnapNoRootHash(c *C) {
+	dir := c.MkDir()
+	snapPath := filepath.Join(dir, "test-snap_1.snap")
+	c.Assert(ioutil.WriteFile(snapPath, []byte("squashfs-data"), 0644), IsNil)
+
+	si := s.addSnapRevision(c, "test-snap", snapPath, "")
+
+	_, err := verity.ParamsForSnap(s.db, snapPath, si)
+	c.Assert(err, ErrorMatches, `snap-revision assertion for "test-snap" carries no dm-verity root hash`)
+}
+
+func (s *veritySuite) TestParamsForSnapShortFileNoFooter(c *C) {
+	dir := c.MkDir()
+	snapPath := filepath.Join(dir, "test-snap_1.snap")
+	c.Assert(ioutil.WriteFile(snapPath, []byte("short"), 0644), IsNil)
+
+	si := s.addSnapRevision(c, "test-snap", snapPath, "deadbeef")
+
+	_, err := verity.ParamsForSnap(s.db, snapPath, si)
+	c.Assert(err, ErrorMatches, `cannot find an appended dm-verity hash tree in .*`)
+}